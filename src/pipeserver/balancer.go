@@ -0,0 +1,100 @@
+package pipeserver
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Balancer picks one target out of the currently healthy set. Pool calls
+// Pick with only the targets it considers healthy right now, so a
+// Balancer never needs to know about failures itself.
+type Balancer interface {
+	Pick(targets []string) string
+}
+
+// balancerObserver is an optional interface a Balancer can implement to be
+// told when a target is handed out or given back, e.g. for LeastInUse
+// bookkeeping. Not part of the Balancer interface itself since most
+// balancers don't need it.
+type balancerObserver interface {
+	acquired(target string)
+	released(target string)
+}
+
+type roundRobinBalancer struct {
+	mu   sync.Mutex
+	next int
+}
+
+// RoundRobin cycles through the healthy targets in order.
+func RoundRobin() Balancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Pick(targets []string) string {
+	if len(targets) == 0 {
+		return ""
+	}
+	b.mu.Lock()
+	i := b.next % len(targets)
+	b.next++
+	b.mu.Unlock()
+	return targets[i]
+}
+
+type randomBalancer struct{}
+
+// Random picks a uniformly random healthy target on every call.
+func Random() Balancer {
+	return randomBalancer{}
+}
+
+func (randomBalancer) Pick(targets []string) string {
+	if len(targets) == 0 {
+		return ""
+	}
+	return targets[rand.Intn(len(targets))]
+}
+
+type leastInUseBalancer struct {
+	mu    sync.Mutex
+	inUse map[string]int
+}
+
+// LeastInUse picks the healthy target with the fewest connections
+// currently checked out of the pool, ties broken by target order.
+func LeastInUse() Balancer {
+	return &leastInUseBalancer{inUse: make(map[string]int)}
+}
+
+func (b *leastInUseBalancer) Pick(targets []string) string {
+	if len(targets) == 0 {
+		return ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	best := targets[0]
+	bestN := b.inUse[best]
+	for _, t := range targets[1:] {
+		if n := b.inUse[t]; n < bestN {
+			best, bestN = t, n
+		}
+	}
+	return best
+}
+
+func (b *leastInUseBalancer) acquired(target string) {
+	b.mu.Lock()
+	b.inUse[target]++
+	b.mu.Unlock()
+}
+
+func (b *leastInUseBalancer) released(target string) {
+	b.mu.Lock()
+	if b.inUse[target] > 0 {
+		b.inUse[target]--
+	}
+	b.mu.Unlock()
+}
@@ -0,0 +1,85 @@
+package pipeserver
+
+import "testing"
+
+func TestRoundRobinCyclesInOrder(t *testing.T) {
+	b := RoundRobin()
+	targets := []string{"a:1", "b:2", "c:3"}
+
+	want := []string{"a:1", "b:2", "c:3", "a:1", "b:2"}
+	for i, w := range want {
+		if got := b.Pick(targets); got != w {
+			t.Fatalf("pick %d: got %q, want %q", i, got, w)
+		}
+	}
+}
+
+func TestRoundRobinEmptyTargets(t *testing.T) {
+	if got := RoundRobin().Pick(nil); got != "" {
+		t.Fatalf("got %q, want empty string", got)
+	}
+}
+
+func TestRandomAlwaysPicksFromTargets(t *testing.T) {
+	b := Random()
+	targets := []string{"a:1", "b:2", "c:3"}
+
+	for i := 0; i < 50; i++ {
+		got := b.Pick(targets)
+		found := false
+		for _, target := range targets {
+			if got == target {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("pick returned %q, not one of %v", got, targets)
+		}
+	}
+}
+
+func TestRandomEmptyTargets(t *testing.T) {
+	if got := Random().Pick(nil); got != "" {
+		t.Fatalf("got %q, want empty string", got)
+	}
+}
+
+func TestLeastInUsePicksFewestInUse(t *testing.T) {
+	b := LeastInUse()
+	targets := []string{"a:1", "b:2", "c:3"}
+
+	obs := b.(balancerObserver)
+	obs.acquired("a:1")
+	obs.acquired("a:1")
+	obs.acquired("b:2")
+
+	if got := b.Pick(targets); got != "c:3" {
+		t.Fatalf("got %q, want c:3 (0 in use)", got)
+	}
+
+	obs.released("a:1")
+	obs.released("a:1")
+
+	if got := b.Pick(targets); got != "a:1" {
+		t.Fatalf("got %q, want a:1 after releasing both uses (tie broken by order)", got)
+	}
+}
+
+func TestLeastInUseReleaseNeverGoesNegative(t *testing.T) {
+	b := LeastInUse()
+	obs := b.(balancerObserver)
+
+	obs.released("a:1")
+	obs.released("a:1")
+
+	if got := b.Pick([]string{"a:1", "b:2"}); got != "a:1" {
+		t.Fatalf("got %q, want a:1 (in-use count should have floored at 0)", got)
+	}
+}
+
+func TestLeastInUseEmptyTargets(t *testing.T) {
+	if got := LeastInUse().Pick(nil); got != "" {
+		t.Fatalf("got %q, want empty string", got)
+	}
+}
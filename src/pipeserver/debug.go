@@ -0,0 +1,13 @@
+package pipeserver
+
+import (
+	"fmt"
+	"os"
+)
+
+func Debugf(format string, args ...interface{}) {
+	if os.Getenv("DEBUG") == "" {
+		return
+	}
+	fmt.Printf(format+"\n", args...)
+}
@@ -0,0 +1,18 @@
+package pipeserver
+
+import "io"
+
+// Framer understands enough of a wire protocol to find message boundaries
+// in a byte stream, so a proxy can forward one complete request/response
+// at a time and return the upstream connection to the pool in between,
+// instead of holding it for a client's whole connection lifetime. Other
+// protocols (memcached ASCII, HTTP/1.1) can plug in by implementing this.
+type Framer interface {
+	// ReadRequest reads one complete client request from r and returns the
+	// raw bytes that made it up, unmodified, ready to forward upstream.
+	ReadRequest(r io.Reader) ([]byte, error)
+
+	// ReadResponse reads one complete upstream reply from r and returns
+	// the raw bytes that made it up, ready to forward to the client.
+	ReadResponse(r io.Reader) ([]byte, error)
+}
@@ -0,0 +1,75 @@
+package pipeserver
+
+import (
+	"sync"
+	"time"
+)
+
+type targetHealth struct {
+	mu             sync.Mutex
+	healthy        bool
+	unhealthyUntil time.Time
+}
+
+// healthTracker records which targets are currently excluded from the
+// balancer after a dial/ping failure, and for how long.
+type healthTracker struct {
+	cooldown time.Duration
+	targets  map[string]*targetHealth
+}
+
+func newHealthTracker(targets []string, cooldown time.Duration) *healthTracker {
+	h := &healthTracker{
+		cooldown: cooldown,
+		targets:  make(map[string]*targetHealth, len(targets)),
+	}
+	for _, t := range targets {
+		h.targets[t] = &targetHealth{healthy: true}
+	}
+	return h
+}
+
+func (h *healthTracker) markUnhealthy(target string) {
+	th, ok := h.targets[target]
+	if !ok {
+		return
+	}
+	th.mu.Lock()
+	th.healthy = false
+	th.unhealthyUntil = time.Now().Add(h.cooldown)
+	th.mu.Unlock()
+}
+
+func (h *healthTracker) markHealthy(target string) {
+	th, ok := h.targets[target]
+	if !ok {
+		return
+	}
+	th.mu.Lock()
+	th.healthy = true
+	th.mu.Unlock()
+}
+
+// isHealthy reports a target as healthy once its cooldown has elapsed even
+// if no probe has confirmed it yet, so a single healthy Get/dial attempt
+// can bring it back into rotation without waiting on the background
+// prober.
+func (h *healthTracker) isHealthy(target string) bool {
+	th, ok := h.targets[target]
+	if !ok {
+		return true
+	}
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return th.healthy || time.Now().After(th.unhealthyUntil)
+}
+
+func (h *healthTracker) healthyTargets(all []string) []string {
+	out := make([]string, 0, len(all))
+	for _, t := range all {
+		if h.isHealthy(t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
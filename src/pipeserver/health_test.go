@@ -0,0 +1,65 @@
+package pipeserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthTrackerStartsAllHealthy(t *testing.T) {
+	h := newHealthTracker([]string{"a:1", "b:2"}, time.Minute)
+
+	if !h.isHealthy("a:1") || !h.isHealthy("b:2") {
+		t.Fatal("targets should start healthy")
+	}
+}
+
+func TestHealthTrackerUnknownTargetIsHealthy(t *testing.T) {
+	h := newHealthTracker([]string{"a:1"}, time.Minute)
+
+	if !h.isHealthy("never-configured:1") {
+		t.Fatal("a target the tracker doesn't know about should report healthy")
+	}
+}
+
+func TestHealthTrackerExcludesUntilCooldown(t *testing.T) {
+	h := newHealthTracker([]string{"a:1"}, 20*time.Millisecond)
+
+	h.markUnhealthy("a:1")
+	if h.isHealthy("a:1") {
+		t.Fatal("target should be excluded immediately after markUnhealthy")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !h.isHealthy("a:1") {
+		t.Fatal("target should recover once its cooldown elapses, even without a probe")
+	}
+}
+
+func TestHealthTrackerMarkHealthyRecoversImmediately(t *testing.T) {
+	h := newHealthTracker([]string{"a:1"}, time.Hour)
+
+	h.markUnhealthy("a:1")
+	h.markHealthy("a:1")
+
+	if !h.isHealthy("a:1") {
+		t.Fatal("markHealthy should clear the cooldown immediately")
+	}
+}
+
+func TestHealthyTargetsFiltersOutUnhealthy(t *testing.T) {
+	h := newHealthTracker([]string{"a:1", "b:2", "c:3"}, time.Hour)
+
+	h.markUnhealthy("b:2")
+
+	got := h.healthyTargets([]string{"a:1", "b:2", "c:3"})
+	want := []string{"a:1", "c:3"}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package pipeserver
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Counter, Gauge and Histogram are minimal Prometheus-text-format metric
+// primitives. There's no vendored client library in this tree, so these
+// cover the handful of series utpools exposes without pulling one in.
+
+type Counter struct {
+	v int64
+}
+
+func (c *Counter) Add(n int64)  { atomic.AddInt64(&c.v, n) }
+func (c *Counter) Value() int64 { return atomic.LoadInt64(&c.v) }
+
+func (c *Counter) WriteTo(w io.Writer, name, help, labels string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s%s %d\n", name, help, name, name, labels, c.Value())
+}
+
+type Gauge struct {
+	v int64
+}
+
+func (g *Gauge) Set(n int64)  { atomic.StoreInt64(&g.v, n) }
+func (g *Gauge) Add(n int64)  { atomic.AddInt64(&g.v, n) }
+func (g *Gauge) Value() int64 { return atomic.LoadInt64(&g.v) }
+
+func (g *Gauge) WriteTo(w io.Writer, name, help, labels string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s%s %d\n", name, help, name, name, labels, g.Value())
+}
+
+// Histogram buckets are cumulative ("le") on render, matching the
+// Prometheus text exposition format, but accumulated internally per-bucket
+// so Observe only ever increments a single bucket counter.
+type Histogram struct {
+	buckets []float64
+	counts  []int64
+	sum     int64 // nanoseconds
+	count   int64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]int64, len(buckets)+1)}
+}
+
+// DefaultAcquireWaitBuckets are reasonable bucket bounds, in seconds, for
+// timing how long callers wait for a pooled connection.
+var DefaultAcquireWaitBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func (h *Histogram) Observe(seconds float64) {
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(seconds*1e9))
+
+	for i, b := range h.buckets {
+		if seconds <= b {
+			atomic.AddInt64(&h.counts[i], 1)
+			return
+		}
+	}
+	atomic.AddInt64(&h.counts[len(h.buckets)], 1)
+}
+
+func (h *Histogram) WriteTo(w io.Writer, name, help, labels string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+
+	cumulative := int64(0)
+	for i, b := range h.buckets {
+		cumulative += atomic.LoadInt64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket%sle=\"%g\"} %d\n", name, labelsWithLE(labels), b, cumulative)
+	}
+	cumulative += atomic.LoadInt64(&h.counts[len(h.buckets)])
+	fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", name, labelsWithLE(labels), cumulative)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, float64(atomic.LoadInt64(&h.sum))/1e9)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, atomic.LoadInt64(&h.count))
+}
+
+// labelsWithLE turns an existing "{a="b"}" label set (or "") into one ready
+// to have another label appended, since the bucket line always adds "le".
+func labelsWithLE(labels string) string {
+	if labels == "" {
+		return "{"
+	}
+	return labels[:len(labels)-1] + ","
+}
+
+// Stats is a point-in-time snapshot of a Pool's internal counters, used to
+// drive the utpools_pool_* gauges.
+type Stats struct {
+	Size    int
+	Idle    int
+	InUse   int
+	Waiters int
+
+	ConnectionsCreated int64
+	ConnectionsClosed  map[string]int64
+
+	AcquireWait *Histogram
+}
+
+// Close reasons reported in ConnectionsClosed / the reason label on
+// utpools_connections_closed_total.
+const (
+	CloseReasonIdle     = "idle"
+	CloseReasonLifetime = "lifetime"
+	CloseReasonError    = "error"
+	CloseReasonShutdown = "shutdown"
+)
+
+type closeCounters struct {
+	idle     Counter
+	lifetime Counter
+	error    Counter
+	shutdown Counter
+}
+
+func (c *closeCounters) inc(reason string) {
+	switch reason {
+	case CloseReasonIdle:
+		c.idle.Add(1)
+	case CloseReasonLifetime:
+		c.lifetime.Add(1)
+	case CloseReasonShutdown:
+		c.shutdown.Add(1)
+	default:
+		c.error.Add(1)
+	}
+}
+
+func (c *closeCounters) snapshot() map[string]int64 {
+	return map[string]int64{
+		CloseReasonIdle:     c.idle.Value(),
+		CloseReasonLifetime: c.lifetime.Value(),
+		CloseReasonError:    c.error.Value(),
+		CloseReasonShutdown: c.shutdown.Value(),
+	}
+}
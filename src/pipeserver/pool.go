@@ -0,0 +1,910 @@
+package pipeserver
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrPoolTimeout      = errors.New("pipeserver: timed out waiting for a connection")
+	ErrPoolExhausted    = errors.New("pipeserver: wait queue is full")
+	ErrPoolClosed       = errors.New("pipeserver: pool has been released")
+	ErrNoHealthyTargets = errors.New("pipeserver: no healthy targets available")
+)
+
+type PoolConfig struct {
+	InitialCap  int
+	MaxCap      int
+	IdleTimeout int
+	Factory     func() (net.Conn, error)
+	Destroy     func(conn net.Conn) error
+
+	// AcquireTimeout bounds how long GetContext/Get will wait on the wait
+	// queue for a connection to free up. Zero means wait forever (or until
+	// ctx is done, for GetContext).
+	AcquireTimeout time.Duration
+
+	// WaitQueueLimit caps the number of callers allowed to queue for a
+	// connection once MaxCap is reached. Zero means unbounded.
+	WaitQueueLimit int
+
+	// MaxLifetime recycles a connection once it has been open this long,
+	// regardless of how recently it was used. Zero means no limit.
+	MaxLifetime time.Duration
+
+	// PingFunc, if set, is run against a pooled connection on Get once its
+	// idle time exceeds PingThreshold. A non-nil error evicts the
+	// connection and Get transparently dials a replacement.
+	PingFunc      func(conn net.Conn) error
+	PingThreshold time.Duration
+
+	// Targets, DialFunc and Balancer put the pool in multi-upstream mode:
+	// Get picks any healthy target via Balancer and dials it with
+	// DialFunc, instead of always dialing through Factory. Balancer
+	// defaults to RoundRobin when Targets is non-empty. Factory is
+	// ignored once Targets is set.
+	Targets  []string
+	DialFunc func(target string) (net.Conn, error)
+	Balancer Balancer
+
+	// FailureCooldown is how long a target is excluded from the balancer
+	// after a dial failure before it's eligible again. Defaults to 5s.
+	FailureCooldown time.Duration
+}
+
+type Pool interface {
+	Get() (net.Conn, error)
+	GetContext(ctx context.Context) (net.Conn, error)
+	Put(conn net.Conn) error
+	Close(conn net.Conn) error
+	Release()
+	Size() int
+
+	// MarkUnusable flags a connection obtained from Get as broken so that
+	// the following Put destroys it instead of returning it to the idle
+	// set.
+	MarkUnusable(conn net.Conn)
+
+	// Stats returns a snapshot of the pool's internal counters, for
+	// exposing as metrics.
+	Stats() Stats
+
+	// Drain puts the pool into draining mode: Put destroys returned
+	// connections instead of keeping them idle, so the pool empties out
+	// as in-flight requests finish instead of staying warm for a restart
+	// that isn't coming. Get/GetContext keep working as before, so a
+	// caller already waiting on one, or one in the middle of a request,
+	// can still complete normally.
+	Drain()
+
+	// Outstanding returns the connections currently checked out via
+	// Get/GetContext. Used at the end of a drain timeout to force-close
+	// whatever a caller never returned.
+	Outstanding() []*PoolConn
+
+	// Resize changes InitialCap/MaxCap and, in multi-target mode, the
+	// target list, in place, so -min/-max/-targets can be reloaded
+	// without restarting the process. A nil targets leaves the existing
+	// target list untouched.
+	Resize(minCap, maxCap int, targets []string) error
+}
+
+// PoolConn wraps a pooled net.Conn so the pool can track its age and idle
+// time without requiring callers to do any bookkeeping of their own.
+type PoolConn struct {
+	net.Conn
+
+	target     string
+	createdAt  time.Time
+	lastUsedAt time.Time
+
+	reader *bufio.Reader
+
+	mu       sync.Mutex
+	unusable bool
+}
+
+// Target returns the upstream this connection was dialed to, or "" when
+// the pool is running in single-target (Factory) mode.
+func (pc *PoolConn) Target() string {
+	return pc.target
+}
+
+// CreatedAt returns when this connection was dialed, so a caller
+// force-closing it outside the normal Put path (e.g. a drain timeout)
+// can report its age.
+func (pc *PoolConn) CreatedAt() time.Time {
+	return pc.createdAt
+}
+
+// Reader returns a *bufio.Reader bound to this connection's lifetime
+// rather than to a single borrow, so a Framer's buffered look-ahead
+// (needed to detect pipelined requests) isn't thrown away each time the
+// connection is handed back to the pool and borrowed again. Safe to call
+// because a checked-out PoolConn is only ever used by one goroutine at a
+// time.
+func (pc *PoolConn) Reader() *bufio.Reader {
+	if pc.reader == nil {
+		pc.reader = bufio.NewReader(pc.Conn)
+	}
+	return pc.reader
+}
+
+func targetOf(conn net.Conn) string {
+	if pc, ok := conn.(*PoolConn); ok {
+		return pc.target
+	}
+	return ""
+}
+
+func (pc *PoolConn) markUnusable() {
+	pc.mu.Lock()
+	pc.unusable = true
+	pc.mu.Unlock()
+}
+
+func (pc *PoolConn) isUnusable() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.unusable
+}
+
+func (pc *PoolConn) touch() {
+	pc.mu.Lock()
+	pc.lastUsedAt = time.Now()
+	pc.mu.Unlock()
+}
+
+func (pc *PoolConn) idleFor(now time.Time) time.Duration {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return now.Sub(pc.lastUsedAt)
+}
+
+type connRequest chan connResult
+
+type connResult struct {
+	conn net.Conn
+	err  error
+}
+
+type connectionPool struct {
+	mu      sync.Mutex
+	conns   chan net.Conn
+	waiters list.List
+
+	numOpen  int
+	maxCap   int
+	closed   bool
+	draining bool
+
+	factory func() (net.Conn, error)
+	destroy func(conn net.Conn) error
+
+	idleTimeout    int
+	acquireTimeout time.Duration
+	waitQueueLimit int
+
+	maxLifetime   time.Duration
+	pingFunc      func(conn net.Conn) error
+	pingThreshold time.Duration
+
+	stopReaper chan struct{}
+	reaperDone chan struct{}
+
+	targetConfig    atomic.Value // *targetConfig
+	dialFunc        func(target string) (net.Conn, error)
+	balancer        Balancer
+	failureCooldown time.Duration
+
+	stopProber chan struct{}
+	proberDone chan struct{}
+
+	outstanding map[*PoolConn]struct{}
+
+	connsCreated Counter
+	connsClosed  closeCounters
+	acquireWait  *Histogram
+}
+
+func NewConnectionPool(config *PoolConfig) (Pool, error) {
+	if config.InitialCap < 0 || config.MaxCap <= 0 || config.InitialCap > config.MaxCap {
+		return nil, errors.New("pipeserver: invalid pool capacity settings")
+	}
+
+	if len(config.Targets) > 0 && config.DialFunc == nil {
+		return nil, errors.New("pipeserver: DialFunc is required when Targets is set")
+	}
+
+	cooldown := config.FailureCooldown
+	if cooldown <= 0 {
+		cooldown = 5 * time.Second
+	}
+
+	balancer := config.Balancer
+	if balancer == nil {
+		balancer = RoundRobin()
+	}
+
+	p := &connectionPool{
+		conns:           make(chan net.Conn, config.MaxCap),
+		maxCap:          config.MaxCap,
+		factory:         config.Factory,
+		destroy:         config.Destroy,
+		idleTimeout:     config.IdleTimeout,
+		acquireTimeout:  config.AcquireTimeout,
+		waitQueueLimit:  config.WaitQueueLimit,
+		maxLifetime:     config.MaxLifetime,
+		pingFunc:        config.PingFunc,
+		pingThreshold:   config.PingThreshold,
+		stopReaper:      make(chan struct{}),
+		reaperDone:      make(chan struct{}),
+		dialFunc:        config.DialFunc,
+		balancer:        balancer,
+		failureCooldown: cooldown,
+		stopProber:      make(chan struct{}),
+		proberDone:      make(chan struct{}),
+		outstanding:     make(map[*PoolConn]struct{}),
+		acquireWait:     NewHistogram(DefaultAcquireWaitBuckets),
+	}
+	p.storeTargetConfig(config.Targets, newHealthTracker(config.Targets, cooldown))
+
+	for i := 0; i < config.InitialCap; i++ {
+		conn, err := p.pickDial()
+		if err != nil {
+			p.Release()
+			return nil, fmt.Errorf("pipeserver: failed to create initial connection: %v", err)
+		}
+		p.numOpen++
+		p.conns <- conn
+	}
+
+	if p.idleTimeout > 0 || p.maxLifetime > 0 {
+		go p.reapLoop()
+	} else {
+		close(p.reaperDone)
+	}
+
+	if len(config.Targets) > 0 {
+		go p.proberLoop()
+	} else {
+		close(p.proberDone)
+	}
+
+	return p, nil
+}
+
+func (p *connectionPool) wrap(conn net.Conn, target string) net.Conn {
+	now := time.Now()
+	p.connsCreated.Add(1)
+	return &PoolConn{Conn: conn, target: target, createdAt: now, lastUsedAt: now}
+}
+
+// targetConfig bundles the target list with the health tracker built for
+// it, so pickDial and friends always see the two together as Resize
+// publishes them, rather than risking a target list from one Resize
+// paired with a healthTracker's map from another.
+type targetConfig struct {
+	targets []string
+	health  *healthTracker
+}
+
+// loadTargetConfig returns the pool's current target list and health
+// tracker. Reading both through a single atomic.Value load, instead of two
+// separate fields, is what lets pickDial and probeUnhealthy run lock-free
+// concurrently with a Resize that's replacing both: they always see a
+// matched pair, never a new target list against the old healthTracker's
+// map (or vice versa) mid-swap.
+func (p *connectionPool) loadTargetConfig() *targetConfig {
+	return p.targetConfig.Load().(*targetConfig)
+}
+
+func (p *connectionPool) storeTargetConfig(targets []string, health *healthTracker) {
+	p.targetConfig.Store(&targetConfig{targets: targets, health: health})
+}
+
+// pickDial dials a new connection, either through the single-target
+// Factory or, in multi-target mode, by asking the Balancer for a healthy
+// target and retrying against another one on failure.
+func (p *connectionPool) pickDial() (net.Conn, error) {
+	tc := p.loadTargetConfig()
+	if len(tc.targets) == 0 {
+		conn, err := p.factory()
+		if err != nil {
+			return nil, err
+		}
+		return p.wrap(conn, ""), nil
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < len(tc.targets); attempt++ {
+		healthy := tc.health.healthyTargets(tc.targets)
+		target := p.balancer.Pick(healthy)
+		if target == "" {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, ErrNoHealthyTargets
+		}
+
+		conn, err := p.dialFunc(target)
+		if err != nil {
+			tc.health.markUnhealthy(target)
+			lastErr = err
+			continue
+		}
+
+		tc.health.markHealthy(target)
+		return p.wrap(conn, target), nil
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrNoHealthyTargets
+}
+
+// isConfiguredTarget reports whether target is still in the pool's
+// current target list, so validate can evict an idle connection dialed to
+// an upstream Resize has since removed, instead of relying on the health
+// tracker, which reports any target it doesn't know about as healthy.
+func (p *connectionPool) isConfiguredTarget(target string) bool {
+	tc := p.loadTargetConfig()
+
+	if len(tc.targets) == 0 {
+		return true
+	}
+	for _, t := range tc.targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *connectionPool) notifyAcquired(target string) {
+	if target == "" {
+		return
+	}
+	if obs, ok := p.balancer.(balancerObserver); ok {
+		obs.acquired(target)
+	}
+}
+
+func (p *connectionPool) notifyReleased(target string) {
+	if target == "" {
+		return
+	}
+	if obs, ok := p.balancer.(balancerObserver); ok {
+		obs.released(target)
+	}
+}
+
+func (p *connectionPool) trackOutstanding(conn net.Conn) {
+	pc, ok := conn.(*PoolConn)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	p.outstanding[pc] = struct{}{}
+	p.mu.Unlock()
+}
+
+func (p *connectionPool) untrackOutstanding(conn net.Conn) {
+	pc, ok := conn.(*PoolConn)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	delete(p.outstanding, pc)
+	p.mu.Unlock()
+}
+
+func (p *connectionPool) Get() (net.Conn, error) {
+	return p.GetContext(context.Background())
+}
+
+func (p *connectionPool) GetContext(ctx context.Context) (net.Conn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		select {
+		case conn := <-p.conns:
+			p.mu.Unlock()
+			usable, err := p.validate(conn)
+			if !usable {
+				continue
+			}
+			p.notifyAcquired(targetOf(conn))
+			p.trackOutstanding(conn)
+			return conn, err
+		default:
+		}
+
+		if p.numOpen < p.maxCap {
+			p.numOpen++
+			p.mu.Unlock()
+
+			conn, err := p.pickDial()
+			if err != nil {
+				p.mu.Lock()
+				p.numOpen--
+				p.mu.Unlock()
+				return nil, err
+			}
+			p.notifyAcquired(targetOf(conn))
+			p.trackOutstanding(conn)
+			return conn, nil
+		}
+
+		if p.waitQueueLimit > 0 && p.waiters.Len() >= p.waitQueueLimit {
+			p.mu.Unlock()
+			return nil, ErrPoolExhausted
+		}
+
+		req := make(connRequest, 1)
+		elem := p.waiters.PushBack(req)
+		p.mu.Unlock()
+
+		waitStart := time.Now()
+
+		var timeout <-chan time.Time
+		if p.acquireTimeout > 0 {
+			timer := time.NewTimer(p.acquireTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case res := <-req:
+			p.acquireWait.Observe(time.Since(waitStart).Seconds())
+			if res.err != nil {
+				return nil, res.err
+			}
+			usable, err := p.validate(res.conn)
+			if !usable {
+				continue
+			}
+			p.notifyAcquired(targetOf(res.conn))
+			p.trackOutstanding(res.conn)
+			return res.conn, err
+		case <-timeout:
+			p.acquireWait.Observe(time.Since(waitStart).Seconds())
+			if !p.removeWaiter(elem) {
+				p.reclaimAbandonedWaiter(elem)
+			}
+			return nil, ErrPoolTimeout
+		case <-ctx.Done():
+			p.acquireWait.Observe(time.Since(waitStart).Seconds())
+			if !p.removeWaiter(elem) {
+				p.reclaimAbandonedWaiter(elem)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// validate checks a connection popped off the idle set (or handed to a
+// waiter by Put) for expiry and liveness before it is returned to the
+// caller. When it returns usable=false the connection has been destroyed
+// and the caller should retry acquiring another one.
+func (p *connectionPool) validate(conn net.Conn) (usable bool, err error) {
+	pc, ok := conn.(*PoolConn)
+	if !ok {
+		return true, nil
+	}
+
+	now := time.Now()
+	if pc.isUnusable() {
+		p.evict(conn, CloseReasonError)
+		return false, nil
+	}
+	if expired, reason := p.expired(pc, now); expired {
+		p.evict(conn, reason)
+		return false, nil
+	}
+
+	if pc.target != "" && !p.isConfiguredTarget(pc.target) {
+		p.evict(conn, CloseReasonError)
+		return false, nil
+	}
+
+	tc := p.loadTargetConfig()
+	if pc.target != "" && !tc.health.isHealthy(pc.target) {
+		p.evict(conn, CloseReasonError)
+		return false, nil
+	}
+
+	if p.pingFunc != nil && p.pingThreshold > 0 && pc.idleFor(now) > p.pingThreshold {
+		if err := p.pingFunc(pc.Conn); err != nil {
+			if pc.target != "" {
+				tc.health.markUnhealthy(pc.target)
+			}
+			p.evict(conn, CloseReasonError)
+			return false, nil
+		}
+	}
+
+	pc.touch()
+	return true, nil
+}
+
+// expired reports whether pc has outlived IdleTimeout or MaxLifetime, and
+// which of the two triggered it (for the closed-connection reason label).
+func (p *connectionPool) expired(pc *PoolConn, now time.Time) (bool, string) {
+	if p.idleTimeout > 0 && pc.idleFor(now) > time.Duration(p.idleTimeout)*time.Second {
+		return true, CloseReasonIdle
+	}
+	if p.maxLifetime > 0 && now.Sub(pc.createdAt) > p.maxLifetime {
+		return true, CloseReasonLifetime
+	}
+	return false, ""
+}
+
+func (p *connectionPool) evict(conn net.Conn, reason string) {
+	p.mu.Lock()
+	p.numOpen--
+	p.mu.Unlock()
+	p.connsClosed.inc(reason)
+	p.destroy(conn)
+}
+
+// removeWaiter removes elem from the wait queue and reports whether it was
+// still there to remove. A false return means a concurrent Put or Release
+// already popped elem and is sending (or has sent) it a connResult, so the
+// caller must receive that result itself instead of abandoning it.
+func (p *connectionPool) removeWaiter(elem *list.Element) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for e := p.waiters.Front(); e != nil; e = e.Next() {
+		if e == elem {
+			p.waiters.Remove(e)
+			return true
+		}
+	}
+	return false
+}
+
+// reclaimAbandonedWaiter receives the connResult a concurrent Put or
+// Release already handed to elem after GetContext gave up waiting on it,
+// and returns any real connection it carries to the pool instead of
+// leaking it.
+func (p *connectionPool) reclaimAbandonedWaiter(elem *list.Element) {
+	res := <-elem.Value.(connRequest)
+	if res.conn != nil {
+		p.Put(res.conn)
+	}
+}
+
+func (p *connectionPool) Put(conn net.Conn) error {
+	if conn == nil {
+		return errors.New("pipeserver: connection is nil")
+	}
+
+	p.notifyReleased(targetOf(conn))
+	p.untrackOutstanding(conn)
+
+	if pc, ok := conn.(*PoolConn); ok {
+		pc.touch()
+		if pc.isUnusable() {
+			return p.evictDestroy(conn, CloseReasonError)
+		}
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.connsClosed.inc(CloseReasonShutdown)
+		return p.destroy(conn)
+	}
+
+	if elem := p.waiters.Front(); elem != nil {
+		p.waiters.Remove(elem)
+		p.mu.Unlock()
+		elem.Value.(connRequest) <- connResult{conn: conn}
+		return nil
+	}
+
+	if p.draining {
+		p.numOpen--
+		p.mu.Unlock()
+		p.connsClosed.inc(CloseReasonShutdown)
+		return p.destroy(conn)
+	}
+
+	select {
+	case p.conns <- conn:
+		p.mu.Unlock()
+		return nil
+	default:
+		p.numOpen--
+		p.mu.Unlock()
+		p.connsClosed.inc(CloseReasonIdle)
+		return p.destroy(conn)
+	}
+}
+
+func (p *connectionPool) evictDestroy(conn net.Conn, reason string) error {
+	p.mu.Lock()
+	p.numOpen--
+	p.mu.Unlock()
+	p.connsClosed.inc(reason)
+	return p.destroy(conn)
+}
+
+func (p *connectionPool) MarkUnusable(conn net.Conn) {
+	if pc, ok := conn.(*PoolConn); ok {
+		pc.markUnusable()
+	}
+}
+
+// Close forcibly destroys conn, a connection previously obtained from
+// Get/GetContext, without going through the normal Put path. Used when a
+// caller needs to reclaim a checked-out connection on its own terms, e.g.
+// force-closing whatever a client never returned by the end of a drain
+// timeout.
+func (p *connectionPool) Close(conn net.Conn) error {
+	p.notifyReleased(targetOf(conn))
+	p.untrackOutstanding(conn)
+	return p.evictDestroy(conn, CloseReasonError)
+}
+
+func (p *connectionPool) Release() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+
+	for elem := p.waiters.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(connRequest) <- connResult{err: ErrPoolClosed}
+	}
+	p.waiters.Init()
+
+	close(p.conns)
+	p.mu.Unlock()
+
+	close(p.stopReaper)
+	<-p.reaperDone
+
+	close(p.stopProber)
+	<-p.proberDone
+
+	for conn := range p.conns {
+		p.connsClosed.inc(CloseReasonShutdown)
+		p.destroy(conn)
+	}
+}
+
+func (p *connectionPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.numOpen
+}
+
+func (p *connectionPool) Drain() {
+	p.mu.Lock()
+	p.draining = true
+	p.mu.Unlock()
+}
+
+func (p *connectionPool) Outstanding() []*PoolConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := make([]*PoolConn, 0, len(p.outstanding))
+	for pc := range p.outstanding {
+		out = append(out, pc)
+	}
+	return out
+}
+
+// Resize rebuilds the idle channel at the new MaxCap (channels can't be
+// resized in place), moving over what idle connections still fit and
+// destroying the rest, then tops numOpen back up to minCap by dialing. A
+// nil targets leaves the balancer's target list and health tracker alone;
+// a non-nil one also evicts any idle connection dialed to a target that's
+// no longer in the new list, so a removed upstream stops being handed out
+// immediately instead of lingering until it happens to fail a ping.
+func (p *connectionPool) Resize(minCap, maxCap int, targets []string) error {
+	if maxCap <= 0 || minCap < 0 || minCap > maxCap {
+		return errors.New("pipeserver: invalid pool capacity settings")
+	}
+
+	p.mu.Lock()
+
+	var targetSet map[string]bool
+	if targets != nil {
+		targetSet = make(map[string]bool, len(targets))
+		for _, t := range targets {
+			targetSet[t] = true
+		}
+		p.storeTargetConfig(targets, newHealthTracker(targets, p.failureCooldown))
+	}
+
+	var toDestroy []net.Conn
+	if maxCap != p.maxCap || targetSet != nil {
+		newConns := make(chan net.Conn, maxCap)
+	drain:
+		for {
+			select {
+			case conn := <-p.conns:
+				if pc, ok := conn.(*PoolConn); ok && targetSet != nil && pc.target != "" && !targetSet[pc.target] {
+					p.numOpen--
+					toDestroy = append(toDestroy, conn)
+					continue
+				}
+				select {
+				case newConns <- conn:
+				default:
+					p.numOpen--
+					toDestroy = append(toDestroy, conn)
+				}
+			default:
+				break drain
+			}
+		}
+		p.conns = newConns
+		p.maxCap = maxCap
+	}
+
+	need := minCap - p.numOpen
+	p.mu.Unlock()
+
+	for _, conn := range toDestroy {
+		p.connsClosed.inc(CloseReasonShutdown)
+		p.destroy(conn)
+	}
+
+	for i := 0; i < need; i++ {
+		conn, err := p.pickDial()
+		if err != nil {
+			Debugf("pipeserver: resize: failed to warm pool to new min: %v", err)
+			break
+		}
+
+		p.mu.Lock()
+		p.numOpen++
+		select {
+		case p.conns <- conn:
+			p.mu.Unlock()
+		default:
+			p.numOpen--
+			p.mu.Unlock()
+			p.connsClosed.inc(CloseReasonIdle)
+			p.destroy(conn)
+		}
+	}
+
+	return nil
+}
+
+func (p *connectionPool) Stats() Stats {
+	p.mu.Lock()
+	size := p.maxCap
+	idle := len(p.conns)
+	inUse := p.numOpen - idle
+	waiters := p.waiters.Len()
+	p.mu.Unlock()
+
+	return Stats{
+		Size:               size,
+		Idle:               idle,
+		InUse:              inUse,
+		Waiters:            waiters,
+		ConnectionsCreated: p.connsCreated.Value(),
+		ConnectionsClosed:  p.connsClosed.snapshot(),
+		AcquireWait:        p.acquireWait,
+	}
+}
+
+// reapLoop periodically walks the idle set closing connections that have
+// exceeded IdleTimeout or MaxLifetime, so a dead redis doesn't leave stale
+// sockets sitting in the pool waiting to be handed to the next client.
+func (p *connectionPool) reapLoop() {
+	defer close(p.reaperDone)
+
+	interval := time.Duration(p.idleTimeout) * time.Second
+	if p.maxLifetime > 0 && (interval == 0 || p.maxLifetime < interval) {
+		interval = p.maxLifetime
+	}
+	interval /= 4
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.reapOnce()
+		case <-p.stopReaper:
+			return
+		}
+	}
+}
+
+func (p *connectionPool) reapOnce() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	n := len(p.conns)
+	p.mu.Unlock()
+
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		select {
+		case conn := <-p.conns:
+			pc, ok := conn.(*PoolConn)
+			if ok {
+				if expired, reason := p.expired(pc, now); expired {
+					p.evict(conn, reason)
+					Debugf("pipeserver: reaped idle connection (age %s, reason %s)", now.Sub(pc.createdAt), reason)
+					continue
+				}
+			}
+			select {
+			case p.conns <- conn:
+			default:
+				p.evict(conn, CloseReasonIdle)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// proberLoop actively dials targets the health tracker currently considers
+// unhealthy so they rejoin the balancer as soon as they answer again,
+// rather than waiting for a client to stumble into one after its cooldown
+// expires.
+func (p *connectionPool) proberLoop() {
+	defer close(p.proberDone)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.probeUnhealthy()
+		case <-p.stopProber:
+			return
+		}
+	}
+}
+
+func (p *connectionPool) probeUnhealthy() {
+	tc := p.loadTargetConfig()
+	for _, target := range tc.targets {
+		if tc.health.isHealthy(target) {
+			continue
+		}
+
+		conn, err := p.dialFunc(target)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+
+		tc.health.markHealthy(target)
+		Debugf("pipeserver: target %s recovered", target)
+	}
+}
@@ -0,0 +1,67 @@
+package pipeserver
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentGetResizeNoDataRace runs Resize concurrently with Get in
+// multi-target mode. pickDial and probeUnhealthy read the target list and
+// health tracker with no lock held, so this must pass under -race: a
+// Resize that replaces both (a new slice plus a brand-new healthTracker
+// with its own map) must never be observable as a torn read, and must
+// never trip Go's own concurrent map read/write detector on
+// healthTracker.targets.
+func TestConcurrentGetResizeNoDataRace(t *testing.T) {
+	dial := func(target string) (net.Conn, error) {
+		return &fakeConn{}, nil
+	}
+
+	p, err := NewConnectionPool(&PoolConfig{
+		MaxCap:         4,
+		Targets:        []string{"a:1", "b:2", "c:3"},
+		DialFunc:       dial,
+		Destroy:        func(c net.Conn) error { return c.Close() },
+		AcquireTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewConnectionPool: %v", err)
+	}
+	defer p.Release()
+
+	var workers sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn, err := p.Get()
+				if err != nil {
+					continue
+				}
+				p.Put(conn)
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		targets := []string{"a:1", "b:2"}
+		if i%2 == 0 {
+			targets = []string{"a:1", "b:2", "c:3"}
+		}
+		p.Resize(0, 4, targets)
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	workers.Wait()
+}
@@ -0,0 +1,41 @@
+package pipeserver
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentStatsResizeNoDataRace runs Stats concurrently with Resize,
+// which mutates p.maxCap under p.mu. Stats must read p.maxCap inside the
+// same locked section as the rest of its snapshot instead of after
+// unlocking, or this trips -race.
+func TestConcurrentStatsResizeNoDataRace(t *testing.T) {
+	p := newTestPool(t, 2, 0)
+	defer p.Release()
+
+	var workers sync.WaitGroup
+	stop := make(chan struct{})
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			p.Stats()
+		}
+	}()
+
+	for i := 1; i <= 2; i++ {
+		newMaxCap := 2 + i%3
+		p.Resize(0, newMaxCap, nil)
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	workers.Wait()
+}
@@ -0,0 +1,396 @@
+package pipeserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeConn is a minimal net.Conn good enough for exercising pool
+// bookkeeping: nothing in these tests reads or writes through it.
+type fakeConn struct {
+	net.Conn
+	closed int32
+}
+
+func (c *fakeConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
+}
+
+func newFakeFactory() func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		return &fakeConn{}, nil
+	}
+}
+
+func newTestPool(t *testing.T, cap int, acquireTimeout time.Duration) *connectionPool {
+	t.Helper()
+
+	p, err := NewConnectionPool(&PoolConfig{
+		InitialCap:     0,
+		MaxCap:         cap,
+		Factory:        newFakeFactory(),
+		Destroy:        func(net.Conn) error { return nil },
+		AcquireTimeout: acquireTimeout,
+	})
+	if err != nil {
+		t.Fatalf("NewConnectionPool: %v", err)
+	}
+	return p.(*connectionPool)
+}
+
+// TestGetContextTimeoutRaceWithPutDoesNotLeakConnection reproduces a waiter
+// whose AcquireTimeout fires at (almost) the same instant a concurrent Put
+// finds it at the front of the queue and hands it a connection. Without the
+// removeWaiter/reclaimAbandonedWaiter coordination, that connection is
+// neither idle, nor outstanding, nor closed, yet numOpen still counts it as
+// open: the pool's effective capacity permanently shrinks by one.
+func TestGetContextTimeoutRaceWithPutDoesNotLeakConnection(t *testing.T) {
+	p := newTestPool(t, 1, 10*time.Millisecond)
+	defer p.Release()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	var getErr error
+	go func() {
+		defer wg.Done()
+		_, getErr = p.GetContext(context.Background())
+	}()
+
+	go func() {
+		defer wg.Done()
+		// Give GetContext a chance to queue as a waiter and for its
+		// AcquireTimeout to fire before Put runs, so Put finds the
+		// waiter still in the list but racing to give up.
+		time.Sleep(15 * time.Millisecond)
+		if err := p.Put(conn); err != nil {
+			t.Errorf("Put: %v", err)
+		}
+	}()
+
+	wg.Wait()
+
+	if getErr == nil {
+		t.Fatal("expected the racing GetContext to observe a timeout")
+	}
+
+	// Either the handoff landed in the idle channel (reclaimed via Put)
+	// or numOpen accounts for it; in both cases a follow-up Get must
+	// succeed without dialing past MaxCap.
+	deadline := time.After(time.Second)
+	for {
+		p.mu.Lock()
+		idle := len(p.conns)
+		numOpen := p.numOpen
+		p.mu.Unlock()
+
+		if idle == 1 && numOpen == 1 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("connection was lost: idle=%d numOpen=%d (want idle=1 numOpen=1)", idle, numOpen)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	if _, err := p.GetContext(context.Background()); err != nil {
+		t.Fatalf("Get after the race should succeed, got: %v", err)
+	}
+}
+
+// TestGetContextCtxDoneRaceWithPutDoesNotLeakConnection is the ctx.Done()
+// counterpart of the AcquireTimeout race above.
+func TestGetContextCtxDoneRaceWithPutDoesNotLeakConnection(t *testing.T) {
+	p := newTestPool(t, 1, 0)
+	defer p.Release()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	var getErr error
+	go func() {
+		defer wg.Done()
+		_, getErr = p.GetContext(ctx)
+	}()
+
+	go func() {
+		defer wg.Done()
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		p.Put(conn)
+	}()
+
+	wg.Wait()
+
+	if getErr == nil {
+		t.Fatal("expected the racing GetContext to observe ctx cancellation")
+	}
+
+	deadline := time.After(time.Second)
+	for {
+		p.mu.Lock()
+		idle := len(p.conns)
+		numOpen := p.numOpen
+		p.mu.Unlock()
+
+		if idle == 1 && numOpen == 1 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("connection was lost: idle=%d numOpen=%d (want idle=1 numOpen=1)", idle, numOpen)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestGetContextFIFOOrder(t *testing.T) {
+	p := newTestPool(t, 1, time.Second)
+	defer p.Release()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	order := make(chan int, 3)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Stagger enqueue order so waiters join the FIFO queue
+			// in a known sequence.
+			time.Sleep(time.Duration(i) * 10 * time.Millisecond)
+			if _, err := p.GetContext(context.Background()); err == nil {
+				order <- i
+				p.Put(conn)
+			}
+		}()
+		time.Sleep(15 * time.Millisecond)
+	}
+
+	p.Put(conn)
+	wg.Wait()
+	close(order)
+
+	var got []int
+	for i := range order {
+		got = append(got, i)
+	}
+	for i, w := range []int{0, 1, 2} {
+		if got[i] != w {
+			t.Fatalf("waiters woke out of FIFO order: got %v", got)
+		}
+	}
+}
+
+func TestGetContextWaitQueueLimit(t *testing.T) {
+	p, err := NewConnectionPool(&PoolConfig{
+		MaxCap:         1,
+		Factory:        newFakeFactory(),
+		Destroy:        func(net.Conn) error { return nil },
+		WaitQueueLimit: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewConnectionPool: %v", err)
+	}
+	defer p.Release()
+
+	if _, err := p.Get(); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	go p.GetContext(context.Background())
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := p.Get(); err != ErrPoolExhausted {
+		t.Fatalf("got %v, want ErrPoolExhausted once the wait queue is full", err)
+	}
+}
+
+func TestReleaseWakesWaitersWithErrPoolClosed(t *testing.T) {
+	p := newTestPool(t, 1, 0)
+
+	if _, err := p.Get(); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := p.GetContext(context.Background())
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	p.Release()
+
+	if err := <-errc; err != ErrPoolClosed {
+		t.Fatalf("got %v, want ErrPoolClosed", err)
+	}
+}
+
+func TestResizeEvictsIdleConnectionsToRemovedTargets(t *testing.T) {
+	dial := func(target string) (net.Conn, error) {
+		return &fakeConn{}, nil
+	}
+
+	p, err := NewConnectionPool(&PoolConfig{
+		MaxCap:   2,
+		Targets:  []string{"a:1", "b:2"},
+		DialFunc: dial,
+		Destroy:  func(c net.Conn) error { return c.Close() },
+	})
+	if err != nil {
+		t.Fatalf("NewConnectionPool: %v", err)
+	}
+	defer p.Release()
+
+	connA, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	pcA := connA.(*PoolConn)
+	if err := p.Put(connA); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if err := p.Resize(0, 2, []string{"b:2"}); err != nil {
+		t.Fatalf("Resize: %v", err)
+	}
+
+	if pcA.target == "a:1" {
+		fc := pcA.Conn.(*fakeConn)
+		if !fc.isClosed() {
+			t.Fatal("Resize dropping a target should close idle conns dialed to it")
+		}
+	}
+}
+
+func TestDrainDestroysReturnedConnections(t *testing.T) {
+	p := newTestPool(t, 1, 0)
+	defer p.Release()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	p.Drain()
+
+	if err := p.Put(conn); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	p.mu.Lock()
+	numOpen := p.numOpen
+	idle := len(p.conns)
+	p.mu.Unlock()
+
+	if numOpen != 0 || idle != 0 {
+		t.Fatalf("draining Put should destroy the connection instead of keeping it idle, got numOpen=%d idle=%d", numOpen, idle)
+	}
+}
+
+func TestPingOnCheckoutEvictsFailingConnection(t *testing.T) {
+	var pinged int32
+	errPingFailed := errors.New("ping failed")
+	p, err := NewConnectionPool(&PoolConfig{
+		MaxCap:  1,
+		Factory: newFakeFactory(),
+		Destroy: func(c net.Conn) error { return c.Close() },
+		PingFunc: func(net.Conn) error {
+			atomic.AddInt32(&pinged, 1)
+			return errPingFailed
+		},
+		PingThreshold: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewConnectionPool: %v", err)
+	}
+	defer p.Release()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	orig := conn.(*PoolConn).Conn.(*fakeConn)
+	if err := p.Put(conn); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	conn, err = p.Get()
+	if err != nil {
+		t.Fatalf("Get after ping failure should dial a replacement: %v", err)
+	}
+	if conn.(*PoolConn).Conn.(*fakeConn) == orig {
+		t.Fatal("Get should not hand back a connection that just failed its checkout ping")
+	}
+	if atomic.LoadInt32(&pinged) == 0 {
+		t.Fatal("PingFunc was never called")
+	}
+}
+
+func TestReapOnceEvictsExpiredIdleConnections(t *testing.T) {
+	p, err := NewConnectionPool(&PoolConfig{
+		MaxCap:      1,
+		Factory:     newFakeFactory(),
+		Destroy:     func(c net.Conn) error { return c.Close() },
+		IdleTimeout: 1, // seconds; reapOnce itself is driven by p.expired, not the loop's timer
+	})
+	if err != nil {
+		t.Fatalf("NewConnectionPool: %v", err)
+	}
+	defer p.Release()
+
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if err := p.Put(conn); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	pc := conn.(*PoolConn)
+	pc.mu.Lock()
+	pc.lastUsedAt = time.Now().Add(-2 * time.Second)
+	pc.mu.Unlock()
+
+	pp := p.(*connectionPool)
+	pp.reapOnce()
+
+	pp.mu.Lock()
+	numOpen := pp.numOpen
+	idle := len(pp.conns)
+	pp.mu.Unlock()
+
+	if numOpen != 0 || idle != 0 {
+		t.Fatalf("reapOnce should have evicted the expired idle connection, got numOpen=%d idle=%d", numOpen, idle)
+	}
+}
@@ -0,0 +1,154 @@
+package pipeserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// RESPFramer frames the Redis Serialization Protocol. A request is a RESP
+// array of bulk strings (*N\r\n$len\r\n...); a response is any one of the
+// five RESP types (simple string, error, integer, bulk string, array).
+// Both are read the same way, since a value is a value regardless of which
+// side sent it.
+type RESPFramer struct{}
+
+// MaxBulkLen and MaxArrayLen bound how large a single bulk string or array
+// element count readRESPValue will believe, since both come straight off
+// the wire from whichever side is talking to us (client or upstream) and
+// an unbounded length field ("$2147483000\r\n") would otherwise force a
+// multi-gigabyte allocation or an absurd element loop from a single line.
+var (
+	MaxBulkLen  = 512 * 1024 * 1024
+	MaxArrayLen = 1024 * 1024
+)
+
+func (RESPFramer) ReadRequest(r io.Reader) ([]byte, error) {
+	return readRESPValue(bufioReaderOf(r))
+}
+
+func (RESPFramer) ReadResponse(r io.Reader) ([]byte, error) {
+	return readRESPValue(bufioReaderOf(r))
+}
+
+// HasBufferedRequest reports whether br's buffer already holds a complete
+// RESP value, without consuming anything. A caller pipelining ahead must
+// check this instead of just br.Buffered() > 0: a few bytes of a second
+// command can already be buffered (a plausible TCP segmentation outcome)
+// without the whole thing being there yet, and calling ReadRequest in
+// that case blocks on the client's next byte instead of returning.
+func (RESPFramer) HasBufferedRequest(br *bufio.Reader) bool {
+	data, _ := br.Peek(br.Buffered())
+	_, ok := completeRESPLen(data)
+	return ok
+}
+
+// bufioReaderOf reuses r if it's already a *bufio.Reader so buffered
+// look-ahead (needed to detect pipelined requests) survives across calls,
+// and only wraps it otherwise.
+func bufioReaderOf(r io.Reader) *bufio.Reader {
+	if br, ok := r.(*bufio.Reader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+func readRESPValue(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("pipeserver: malformed RESP line")
+	}
+
+	switch line[0] {
+	case '+', '-', ':':
+		return line, nil
+	case '$':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return nil, errors.New("pipeserver: malformed RESP bulk length")
+		}
+		if n < 0 {
+			return line, nil
+		}
+		if n > MaxBulkLen {
+			return nil, fmt.Errorf("pipeserver: RESP bulk length %d exceeds MaxBulkLen %d", n, MaxBulkLen)
+		}
+		body := make([]byte, n+2)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return nil, err
+		}
+		return append(line, body...), nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return nil, errors.New("pipeserver: malformed RESP array length")
+		}
+		if n > MaxArrayLen {
+			return nil, fmt.Errorf("pipeserver: RESP array length %d exceeds MaxArrayLen %d", n, MaxArrayLen)
+		}
+		out := line
+		for i := 0; i < n; i++ {
+			elem, err := readRESPValue(br)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, elem...)
+		}
+		return out, nil
+	default:
+		// Inline command: the already \r\n-terminated line is the whole
+		// request, as sent by telnet-style clients.
+		return line, nil
+	}
+}
+
+// completeRESPLen reports how many leading bytes of data make up one
+// complete RESP value, purely by inspecting data (no reads), so it can
+// answer "is the next value fully buffered yet" without risking a block
+// on more input. A malformed or over-limit length is treated as complete
+// at the line, the same amount readRESPValue would consume before
+// returning its own error.
+func completeRESPLen(data []byte) (int, bool) {
+	i := bytes.Index(data, []byte("\r\n"))
+	if i < 0 {
+		return 0, false
+	}
+	line := data[:i+2]
+
+	switch line[0] {
+	case '+', '-', ':':
+		return len(line), true
+	case '$':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil || n < 0 || n > MaxBulkLen {
+			return len(line), true
+		}
+		need := len(line) + n + 2
+		if len(data) < need {
+			return 0, false
+		}
+		return need, true
+	case '*':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil || n > MaxArrayLen {
+			return len(line), true
+		}
+		total := len(line)
+		for i := 0; i < n; i++ {
+			elemLen, ok := completeRESPLen(data[total:])
+			if !ok {
+				return 0, false
+			}
+			total += elemLen
+		}
+		return total, true
+	default:
+		return len(line), true
+	}
+}
@@ -0,0 +1,125 @@
+package pipeserver
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadRequestArrayOfBulkStrings(t *testing.T) {
+	raw := "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n"
+
+	got, err := RESPFramer{}.ReadRequest(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != raw {
+		t.Fatalf("got %q, want %q", got, raw)
+	}
+}
+
+func TestReadRequestInlineCommand(t *testing.T) {
+	raw := "PING\r\n"
+
+	got, err := RESPFramer{}.ReadRequest(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != raw {
+		t.Fatalf("got %q, want %q", got, raw)
+	}
+}
+
+func TestReadRequestNullBulkString(t *testing.T) {
+	raw := "$-1\r\n"
+
+	got, err := RESPFramer{}.ReadRequest(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != raw {
+		t.Fatalf("got %q, want %q", got, raw)
+	}
+}
+
+func TestReadResponseSimpleTypes(t *testing.T) {
+	cases := []string{"+OK\r\n", "-ERR oops\r\n", ":42\r\n"}
+
+	for _, raw := range cases {
+		got, err := RESPFramer{}.ReadResponse(strings.NewReader(raw))
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", raw, err)
+		}
+		if string(got) != raw {
+			t.Fatalf("%q: got %q", raw, got)
+		}
+	}
+}
+
+func TestReadRequestMalformedLength(t *testing.T) {
+	if _, err := (RESPFramer{}).ReadRequest(strings.NewReader("$notanumber\r\nx\r\n")); err == nil {
+		t.Fatal("expected an error for a malformed bulk length")
+	}
+}
+
+func TestReadRequestRejectsOversizedBulkLength(t *testing.T) {
+	defer func(n int) { MaxBulkLen = n }(MaxBulkLen)
+	MaxBulkLen = 1024
+
+	if _, err := (RESPFramer{}).ReadRequest(strings.NewReader("$2147483000\r\n")); err == nil {
+		t.Fatal("expected an error for a bulk length over MaxBulkLen, not an attempted multi-gigabyte allocation")
+	}
+}
+
+func TestReadRequestRejectsOversizedArrayLength(t *testing.T) {
+	defer func(n int) { MaxArrayLen = n }(MaxArrayLen)
+	MaxArrayLen = 16
+
+	if _, err := (RESPFramer{}).ReadRequest(strings.NewReader("*2147483000\r\n")); err == nil {
+		t.Fatal("expected an error for an array length over MaxArrayLen")
+	}
+}
+
+func TestHasBufferedRequestOnPartialValue(t *testing.T) {
+	// "$3\r\nfo" is a bulk string header whose 3-byte body hasn't fully
+	// arrived yet (a plausible TCP segmentation outcome).
+	br := bufio.NewReader(strings.NewReader("$3\r\nfo"))
+	// Prime the buffer without blocking on the short read: Peek forces
+	// bufio to fill from the reader up to what's available.
+	br.Peek(1)
+
+	framer := RESPFramer{}
+	if framer.HasBufferedRequest(br) {
+		t.Fatal("a bulk string whose body isn't fully buffered yet should not be reported complete")
+	}
+}
+
+func TestHasBufferedRequestOnCompleteValue(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("$3\r\nfoo\r\n"))
+	br.Peek(1)
+
+	framer := RESPFramer{}
+	if !framer.HasBufferedRequest(br) {
+		t.Fatal("a fully buffered bulk string should be reported complete")
+	}
+}
+
+func TestReadRequestNestedArray(t *testing.T) {
+	raw := "*2\r\n*1\r\n$1\r\na\r\n$1\r\nb\r\n"
+
+	got, err := RESPFramer{}.ReadRequest(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(got) != raw {
+		t.Fatalf("got %q, want %q", got, raw)
+	}
+}
+
+func TestBufioReaderOfReusesExistingReader(t *testing.T) {
+	br := bufio.NewReader(bytes.NewReader(nil))
+	if bufioReaderOf(br) != br {
+		t.Fatal("bufioReaderOf should return the same *bufio.Reader instead of wrapping it again")
+	}
+}
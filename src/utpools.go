@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"net"
+	"net/http"
+	"net/http/pprof"
 	"fmt"
+	"io"
 	"os"
 	"pipeserver"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 	"sync"
@@ -13,13 +20,60 @@ import (
 	"flag"
 )
 
-var optionTargetListen    = flag.String("target", ":6379", "target server ip:port")
+var optionTargetListen    = flag.String("target", ":6379", "target server ip:port (ignored if -targets is set)")
+var optionTargets         = flag.String("targets", "", "comma separated list of target ip:port upstreams to load balance across")
+var optionBalancer        = flag.String("balancer", "roundrobin", "balancer strategy when -targets is set: roundrobin, random, or leastinuse")
+var optionFailureCooldown = flag.Duration("failure-cooldown", 5*time.Second, "how long a target is excluded after a dial failure")
 var optionMinNum          = flag.Int("min", 5, "pool min num")
 var optionMaxNum          = flag.Int("max", 20, "pool max num")
 var optionIdleTimeout     = flag.Int("idle", 3600, "pool connection idle timeout to close")
 var optionShutdownTimeout = flag.Uint("timeout", 60, "timeout to shutdown server")
 var optionUnixDomainFile  = flag.String("unix", "/tmp/utpools.sock", "unix domain socket file")
 var optionVerbose         = flag.Bool("verbose", false, `show run details`)
+var optionAcquireTimeout  = flag.Duration("acquire-timeout", 5*time.Second, "max time to wait for a pooled connection once the pool is full")
+var optionWaitQueueLimit  = flag.Int("wait-queue-limit", 0, "max number of clients allowed to queue for a connection (0 = unbounded)")
+var optionMaxLifetime     = flag.Duration("max-lifetime", 0, "max lifetime of a pooled connection before it's recycled (0 = unlimited)")
+var optionPingThreshold   = flag.Duration("ping-idle-threshold", 0, "ping a pooled connection before reuse once it's been idle this long (0 = disabled)")
+var optionProtocol        = flag.String("protocol", "raw", "framing mode: raw (byte copy for the connection's lifetime) or resp (RESP-aware, returns the upstream conn to the pool after each request)")
+var optionMetricsListen   = flag.String("metrics", "", "address to serve Prometheus metrics on, e.g. :9121 (empty disables it)")
+var optionDebugPprof      = flag.Bool("debug-pprof", false, "also expose /debug/pprof on the metrics listener")
+var optionReloadFile      = flag.String("reload-config", "", "optional file of min=, max= and targets= lines re-read on SIGHUP to resize the pool without a restart; falls back to the original -min/-max/-targets when unset")
+
+var (
+	clientConnsActive pipeserver.Gauge
+	bytesUp           pipeserver.Counter
+	bytesDown         pipeserver.Counter
+)
+
+// clientConns tracks connections currently being served so a drain can
+// nudge each one to wind down at its next request boundary instead of
+// waiting out the full shutdown timeout.
+var (
+	clientConnsMu sync.Mutex
+	clientConns   = make(map[net.Conn]struct{})
+)
+
+func trackClient(conn net.Conn) {
+	clientConnsMu.Lock()
+	clientConns[conn] = struct{}{}
+	clientConnsMu.Unlock()
+}
+
+func untrackClient(conn net.Conn) {
+	clientConnsMu.Lock()
+	delete(clientConns, conn)
+	clientConnsMu.Unlock()
+}
+
+// DrainSignal nudges an in-flight client connection to wind down at its
+// next request boundary during a graceful shutdown. Setting a read
+// deadline is enough for both framing modes: in raw mode the next Read
+// times out and the Pipe's goroutines unwind; in resp mode the next
+// ReadRequest fails and PipeRESP returns. It's a var so a future framing
+// mode could swap in a protocol-level "going away" notice instead.
+var DrainSignal = func(conn net.Conn) {
+	conn.SetReadDeadline(time.Now())
+}
 
 func usage() {
 	fmt.Printf("Usage: %s [options]\nOptions:\n", os.Args[0])
@@ -38,11 +92,32 @@ func main() {
 	}
 
 	config := &pipeserver.PoolConfig{
-		InitialCap  : *optionMinNum,
-		MaxCap      : *optionMaxNum,
-		IdleTimeout : *optionIdleTimeout,
-		Factory     : func() (net.Conn, error) {return net.Dial("tcp", *optionTargetListen)},
-		Destroy     : func(conn net.Conn) error {return conn.Close()},
+		InitialCap     : *optionMinNum,
+		MaxCap         : *optionMaxNum,
+		IdleTimeout    : *optionIdleTimeout,
+		Factory        : func() (net.Conn, error) {return net.Dial("tcp", *optionTargetListen)},
+		Destroy        : func(conn net.Conn) error {return conn.Close()},
+		AcquireTimeout : *optionAcquireTimeout,
+		WaitQueueLimit : *optionWaitQueueLimit,
+		MaxLifetime    : *optionMaxLifetime,
+		PingThreshold  : *optionPingThreshold,
+	}
+
+	if *optionPingThreshold > 0 {
+		config.PingFunc = pingTarget
+	}
+
+	if targets := parseTargets(*optionTargets); len(targets) > 0 {
+		config.Targets = targets
+		config.DialFunc = func(target string) (net.Conn, error) {return net.Dial("tcp", target)}
+		config.FailureCooldown = *optionFailureCooldown
+
+		balancer, err := newBalancer(*optionBalancer)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		config.Balancer = balancer
 	}
 
 	pools, err := pipeserver.NewConnectionPool(config)
@@ -51,6 +126,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *optionMetricsListen != "" {
+		go serveMetrics(*optionMetricsListen, pools, *optionDebugPprof)
+	}
+
 	connWaitGroup := &sync.WaitGroup{}
 
 	listener, err := net.ListenUnix("unix", &net.UnixAddr{*optionUnixDomainFile, "unix"})
@@ -76,46 +155,285 @@ func main() {
 
 			go func() {
 				connWaitGroup.Add(1)
-				handleConn(pools, conn)
+				handleConn(pools, conn, *optionProtocol)
 				connWaitGroup.Done()
 			}()
 		}
 	}()
 
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
 	for s := range sigs {
+		if s == syscall.SIGHUP {
+			reload(pools)
+			continue
+		}
+
 		fmt.Printf("receive shutdown signal %v\n", s)
-		listener.SetDeadline(time.Now())
+		drain(listener, pools, connWaitGroup, *optionShutdownTimeout, *optionUnixDomainFile)
+		break;
+	}
 
-		tt := time.NewTimer(time.Second * time.Duration(*optionShutdownTimeout))
-		wait := make(chan struct{})
-		go func() {
-			connWaitGroup.Wait()
-			wait <- struct{}{}
-		}()
+	os.Exit(0)
+}
 
-		select {
-		case <-tt.C:
-		case <-wait:
+// drain runs the graceful shutdown sequence: stop accepting, put the
+// pool into draining mode so Puts stop keeping connections warm, nudge
+// every in-flight client connection to wind down at its next request
+// boundary, wait up to timeoutSeconds for them to finish, then
+// force-close whatever upstream connection is still checked out.
+func drain(listener *net.UnixListener, pool pipeserver.Pool, wg *sync.WaitGroup, timeoutSeconds uint, socketFile string) {
+	listener.SetDeadline(time.Now())
+
+	pool.Drain()
+
+	clientConnsMu.Lock()
+	for conn := range clientConns {
+		DrainSignal(conn)
+	}
+	clientConnsMu.Unlock()
+
+	tt := time.NewTimer(time.Second * time.Duration(timeoutSeconds))
+	wait := make(chan struct{})
+	go func() {
+		wg.Wait()
+		wait <- struct{}{}
+	}()
+
+	select {
+	case <-tt.C:
+	case <-wait:
+	}
+	tt.Stop()
+
+	for _, pc := range pool.Outstanding() {
+		fmt.Printf("drain timeout: force-closing upstream connection to %s (age %s)\n", pc.RemoteAddr(), time.Since(pc.CreatedAt()))
+		pool.Close(pc)
+	}
+
+	os.Remove(socketFile)
+}
+
+// reload re-applies -min/-max/-targets (or, if -reload-config is set,
+// that file's current contents) to the running pool, so SIGHUP can
+// resize it or swap its target list without a restart.
+func reload(pool pipeserver.Pool) {
+	min, max, targets := *optionMinNum, *optionMaxNum, parseTargets(*optionTargets)
+
+	if *optionReloadFile != "" {
+		cfg, err := readReloadFile(*optionReloadFile)
+		if err != nil {
+			fmt.Printf("reload: %v\n", err)
+			return
 		}
+		if cfg.min >= 0 {
+			min = cfg.min
+		}
+		if cfg.max >= 0 {
+			max = cfg.max
+		}
+		if cfg.targets != nil {
+			targets = cfg.targets
+		}
+	}
 
-		os.Remove(*optionUnixDomainFile)
-		break;
+	if err := pool.Resize(min, max, targets); err != nil {
+		fmt.Printf("reload: %v\n", err)
+		return
 	}
 
-	os.Exit(0)
+	fmt.Printf("reloaded pool: min=%d max=%d targets=%v\n", min, max, targets)
+}
+
+type reloadConfig struct {
+	min     int
+	max     int
+	targets []string
+}
+
+// readReloadFile parses a simple "key=value" per line config, used by
+// -reload-config, since this tool otherwise has no config file of its
+// own to re-read on SIGHUP.
+func readReloadFile(path string) (reloadConfig, error) {
+	cfg := reloadConfig{min: -1, max: -1}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		switch key {
+		case "min":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid min %q: %v", val, err)
+			}
+			cfg.min = n
+		case "max":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid max %q: %v", val, err)
+			}
+			cfg.max = n
+		case "targets":
+			cfg.targets = parseTargets(val)
+		}
+	}
+
+	return cfg, nil
+}
+
+func parseTargets(raw string) []string {
+	var targets []string
+	for _, t := range strings.Split(raw, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+func newBalancer(name string) (pipeserver.Balancer, error) {
+	switch name {
+	case "roundrobin":
+		return pipeserver.RoundRobin(), nil
+	case "random":
+		return pipeserver.Random(), nil
+	case "leastinuse":
+		return pipeserver.LeastInUse(), nil
+	default:
+		return nil, fmt.Errorf("unknown -balancer %q", name)
+	}
+}
+
+// pingTarget sends a RESP PING to a pooled redis connection and consumes
+// the "+PONG\r\n" reply, so Get can evict a connection whose peer already
+// hung up instead of handing a dead socket to the next client.
+func pingTarget(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		return err
+	}
+
+	b := make([]byte, 7)
+	_, err := io.ReadFull(conn, b)
+	return err
 }
 
-func handleConn(pool pipeserver.Pool, conn net.Conn) error {
+// serveMetrics runs a Prometheus /metrics endpoint (and, if enabled,
+// /debug/pprof) until the process exits. It never holds up the proxy's own
+// shutdown, so a scrape in flight is simply dropped along with the rest of
+// the listener.
+func serveMetrics(addr string, pool pipeserver.Pool, enablePprof bool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeMetrics(w, pool)
+	})
+
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Printf("metrics server stopped: %v\n", err)
+	}
+}
+
+func writeMetrics(w http.ResponseWriter, pool pipeserver.Pool) {
+	stats := pool.Stats()
+
+	writeGauge(w, "utpools_pool_size", "configured max pool size", int64(stats.Size))
+	writeGauge(w, "utpools_pool_idle", "idle pooled connections", int64(stats.Idle))
+	writeGauge(w, "utpools_pool_inuse", "pooled connections currently checked out", int64(stats.InUse))
+	writeGauge(w, "utpools_pool_waiters", "callers waiting for a pooled connection", int64(stats.Waiters))
+	writeGauge(w, "utpools_client_connections_active", "client connections currently being served", clientConnsActive.Value())
+
+	writeCounter(w, "utpools_connections_created_total", "pooled connections dialed", stats.ConnectionsCreated)
+	writeCounterFamily(w, "utpools_connections_closed_total", "pooled connections closed", "reason", stats.ConnectionsClosed)
+
+	if stats.AcquireWait != nil {
+		stats.AcquireWait.WriteTo(w, "utpools_acquire_wait_seconds", "time spent waiting for a pooled connection", "")
+	}
+
+	writeCounterFamily(w, "utpools_bytes_transferred_total", "bytes proxied between clients and upstreams", "direction", map[string]int64{
+		"up":   bytesUp.Value(),
+		"down": bytesDown.Value(),
+	})
+}
+
+func writeGauge(w http.ResponseWriter, name, help string, v int64) {
+	var g pipeserver.Gauge
+	g.Set(v)
+	g.WriteTo(w, name, help, "")
+}
+
+func writeCounter(w http.ResponseWriter, name, help string, v int64) {
+	var c pipeserver.Counter
+	c.Add(v)
+	c.WriteTo(w, name, help, "")
+}
+
+func writeCounterFamily(w http.ResponseWriter, name, help, labelName string, samples map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	labels := make([]string, 0, len(samples))
+	for label := range samples {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, labelName, label, samples[label])
+	}
+}
+
+func handleConn(pool pipeserver.Pool, conn net.Conn, protocol string) error {
 	defer conn.Close()
 
+	trackClient(conn)
+	defer untrackClient(conn)
+
+	clientConnsActive.Add(1)
+	defer clientConnsActive.Add(-1)
+
+	if protocol == "resp" {
+		return PipeRESP(pool, conn)
+	}
+
 	pipeserver.Debugf("client connected and pool size %d", pool.Size())
 
 	target, err := pool.Get()
 	if err != nil {
-		return fmt.Errorf("can't connect target")
+		switch err {
+		case pipeserver.ErrPoolTimeout:
+			return fmt.Errorf("can't connect target: timed out waiting for a pooled connection")
+		case pipeserver.ErrPoolExhausted:
+			return fmt.Errorf("can't connect target: wait queue is full")
+		case pipeserver.ErrPoolClosed:
+			return fmt.Errorf("can't connect target: pool is shutting down")
+		default:
+			return fmt.Errorf("can't connect target: %v", err)
+		}
 	}
 
 	pipeserver.Debugf("client to target and pool size %d", pool.Size())
@@ -125,7 +443,7 @@ func handleConn(pool pipeserver.Pool, conn net.Conn) error {
 	return nil
 }
 
-func chanFromConn(pool pipeserver.Pool, conn net.Conn) chan []byte {
+func chanFromConn(pool pipeserver.Pool, conn net.Conn, counter *pipeserver.Counter) chan []byte {
 	c := make(chan []byte)
 
 	go func() {
@@ -135,12 +453,16 @@ func chanFromConn(pool pipeserver.Pool, conn net.Conn) chan []byte {
 			n, err := conn.Read(b)
 			if err != nil {
 				if nerr, ok := err.(net.Error); !ok || false == nerr.Timeout() {
+					if pool != nil {
+						pool.MarkUnusable(conn)
+					}
 					c <- nil
 				}
 				break
 			}
 
 			if n > 0 {
+				counter.Add(int64(n))
 				res := make([]byte, n)
 				copy(res, b[:n])
 				select {
@@ -163,8 +485,8 @@ func chanFromConn(pool pipeserver.Pool, conn net.Conn) chan []byte {
 
 
 func Pipe(pool pipeserver.Pool, src net.Conn, dst net.Conn) {
-	sc := chanFromConn(nil, src)
-	dc := chanFromConn(pool, dst)
+	sc := chanFromConn(nil, src, &bytesUp)
+	dc := chanFromConn(pool, dst, &bytesDown)
 
 	for {
 		select {
@@ -183,4 +505,77 @@ func Pipe(pool pipeserver.Pool, src net.Conn, dst net.Conn) {
 			}
 		}
 	}
+}
+
+// PipeRESP frames the client byte stream as RESP requests instead of
+// copying raw bytes, so a keep-alive client like phpredis or redis-cli
+// only holds its borrowed upstream connection for as long as a request
+// takes, rather than for its whole lifetime. When the client has several
+// requests already buffered (pipelining), they're all dispatched on the
+// same borrowed upstream before it's returned to the pool.
+func PipeRESP(pool pipeserver.Pool, client net.Conn) error {
+	framer := pipeserver.RESPFramer{}
+	reader := bufio.NewReader(client)
+
+	for {
+		reqs := make([][]byte, 0, 1)
+
+		req, err := framer.ReadRequest(reader)
+		if err != nil {
+			return nil
+		}
+		reqs = append(reqs, req)
+
+		for reader.Buffered() > 0 && framer.HasBufferedRequest(reader) {
+			req, err := framer.ReadRequest(reader)
+			if err != nil {
+				break
+			}
+			reqs = append(reqs, req)
+		}
+
+		target, err := pool.Get()
+		if err != nil {
+			pipeserver.Debugf("resp pipe: can't get upstream: %v", err)
+			return err
+		}
+
+		if err := dispatchRESP(pool, framer, target, client, reqs); err != nil {
+			pipeserver.Debugf("resp pipe: %v", err)
+			return nil
+		}
+	}
+}
+
+// dispatchRESP forwards reqs to target in order, writing back each
+// matching reply, and always returns target to the pool before it
+// returns.
+func dispatchRESP(pool pipeserver.Pool, framer pipeserver.RESPFramer, target net.Conn, client net.Conn, reqs [][]byte) error {
+	defer pool.Put(target)
+
+	targetReader := io.Reader(target)
+	if pc, ok := target.(*pipeserver.PoolConn); ok {
+		targetReader = pc.Reader()
+	}
+
+	for _, req := range reqs {
+		if _, err := target.Write(req); err != nil {
+			pool.MarkUnusable(target)
+			return err
+		}
+		bytesUp.Add(int64(len(req)))
+
+		resp, err := framer.ReadResponse(targetReader)
+		if err != nil {
+			pool.MarkUnusable(target)
+			return err
+		}
+
+		if _, err := client.Write(resp); err != nil {
+			return err
+		}
+		bytesDown.Add(int64(len(resp)))
+	}
+
+	return nil
 }
\ No newline at end of file